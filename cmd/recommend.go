@@ -0,0 +1,93 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2022 Authors of KubeArmor
+
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/kubearmor/kubearmor-client/recommend"
+	"github.com/spf13/cobra"
+	"k8s.io/client-go/kubernetes"
+)
+
+var (
+	recommendImage    string
+	recommendPlatform string
+
+	recommendVerifySignature      bool
+	recommendCosignKeyPath        string
+	recommendCosignCertIdentity   string
+	recommendCosignCertOIDCIssuer string
+	recommendNotaryServer         string
+
+	recommendRegistryAuthFile string
+	recommendImagePullSecret  string
+)
+
+// RecommendCmd generates a KubeArmor policy recommendation for a container
+// image.
+var RecommendCmd = &cobra.Command{
+	Use:   "recommend",
+	Short: "Recommend KubeArmor policies based on image context",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if recommendImage == "" {
+			return fmt.Errorf("--image is required")
+		}
+
+		if recommendPlatform != "" {
+			os, arch, variant, err := parsePlatform(recommendPlatform)
+			if err != nil {
+				return err
+			}
+			recommend.SetPlatform(os, arch, variant)
+		}
+
+		recommend.SetVerifyOptions(recommend.VerifyOptions{
+			RequireVerification:  recommendVerifySignature,
+			CosignKeyPath:        recommendCosignKeyPath,
+			CosignCertIdentity:   recommendCosignCertIdentity,
+			CosignCertOIDCIssuer: recommendCosignCertOIDCIssuer,
+			NotaryServer:         recommendNotaryServer,
+		})
+
+		var clientset kubernetes.Interface
+		if recommendImagePullSecret != "" {
+			clientset = k8sClient.K8sClientset
+		}
+		recommend.SetAuthOptions(recommendRegistryAuthFile, recommendImagePullSecret, clientset)
+
+		return recommend.Image(recommendImage)
+	},
+}
+
+// parsePlatform splits a docker-style "os/arch[/variant]" platform string,
+// the same format --platform accepts for `docker pull`/`docker run`.
+func parsePlatform(s string) (os, arch, variant string, err error) {
+	parts := strings.Split(s, "/")
+	switch len(parts) {
+	case 2:
+		return parts[0], parts[1], "", nil
+	case 3:
+		return parts[0], parts[1], parts[2], nil
+	default:
+		return "", "", "", fmt.Errorf("--platform must be os/arch or os/arch/variant, got %q", s)
+	}
+}
+
+func init() {
+	RecommendCmd.Flags().StringVar(&recommendImage, "image", "", "image to generate a policy recommendation for")
+	RecommendCmd.Flags().StringVar(&recommendPlatform, "platform", "", "pull this platform (os/arch[/variant]) from a multi-arch image, defaults to the host platform")
+
+	RecommendCmd.Flags().BoolVar(&recommendVerifySignature, "verify-signature", false, "refuse to generate a policy from an image that doesn't verify against --cosign-key, --cosign-cert-identity/--cosign-cert-oidc-issuer, or --notary-server")
+	RecommendCmd.Flags().StringVar(&recommendCosignKeyPath, "cosign-key", "", "cosign public key to verify the image's signature against")
+	RecommendCmd.Flags().StringVar(&recommendCosignCertIdentity, "cosign-cert-identity", "", "expected keyless signing certificate identity")
+	RecommendCmd.Flags().StringVar(&recommendCosignCertOIDCIssuer, "cosign-cert-oidc-issuer", "", "expected keyless signing certificate OIDC issuer")
+	RecommendCmd.Flags().StringVar(&recommendNotaryServer, "notary-server", "", "notary v1/TUF server to verify the image's signed digest against")
+
+	RecommendCmd.Flags().StringVar(&recommendRegistryAuthFile, "registry-auth-file", "", "docker config.json-style credentials file to use instead of the default docker/podman locations")
+	RecommendCmd.Flags().StringVar(&recommendImagePullSecret, "image-pull-secret", "", "kubernetes.io/dockerconfigjson secret (\"<namespace>/<name>\") to resolve registry credentials from")
+
+	RootCmd.AddCommand(RecommendCmd)
+}
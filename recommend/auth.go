@@ -0,0 +1,266 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2022 Authors of KubeArmor
+
+package recommend
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// registryAuthFile and imagePullSecret are set by the recommend command's
+// --registry-auth-file and --image-pull-secret flags, respectively.
+var registryAuthFile string
+var imagePullSecret string // "<namespace>/<name>"
+var imagePullSecretClientset kubernetes.Interface
+
+// SetAuthOptions configures where authCreds looks for registry credentials,
+// beyond the default docker/podman config locations. clientset is only
+// needed when pullSecret is set, to fetch the imagePullSecret in-cluster.
+func SetAuthOptions(authFile, pullSecret string, clientset kubernetes.Interface) {
+	registryAuthFile = authFile
+	imagePullSecret = pullSecret
+	imagePullSecretClientset = clientset
+}
+
+// dockerConfig is the subset of ~/.docker/config.json recommend cares about.
+type dockerConfig struct {
+	Auths       map[string]dockerConfigAuth `json:"auths"`
+	CredsStore  string                      `json:"credsStore"`
+	CredHelpers map[string]string           `json:"credHelpers"`
+}
+
+type dockerConfigAuth struct {
+	Auth string `json:"auth"`
+}
+
+// authResolver resolves per-registry credentials the same way docker/podman
+// do: the config file's "auths" section, falling back to credsStore/credHelpers.
+type authResolver struct {
+	cfg dockerConfig
+}
+
+// newAuthResolver loads credentials from, in order: --registry-auth-file,
+// $DOCKER_CONFIG/config.json, ~/.docker/config.json, and
+// $XDG_RUNTIME_DIR/containers/auth.json (the podman/buildah location).
+func newAuthResolver() (*authResolver, error) {
+	for _, path := range configCandidates() {
+		if path == "" {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Clean(path))
+		if err != nil {
+			continue
+		}
+		var cfg dockerConfig
+		if err := json.Unmarshal(b, &cfg); err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"path": path,
+			}).Warn("could not parse registry auth file, skipping")
+			continue
+		}
+		return &authResolver{cfg: cfg}, nil
+	}
+	return &authResolver{}, nil
+}
+
+func configCandidates() []string {
+	candidates := []string{registryAuthFile}
+
+	if dc := os.Getenv("DOCKER_CONFIG"); dc != "" {
+		candidates = append(candidates, filepath.Join(dc, "config.json"))
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		candidates = append(candidates, filepath.Join(home, ".docker", "config.json"))
+	}
+	if xdg := os.Getenv("XDG_RUNTIME_DIR"); xdg != "" {
+		candidates = append(candidates, filepath.Join(xdg, "containers", "auth.json"))
+	}
+	return candidates
+}
+
+// dockerHubRegistry is how go-containerregistry normalizes Docker Hub
+// references (name.Context().RegistryStr()).
+const dockerHubRegistry = "index.docker.io"
+
+// dockerHubLegacyKey is the key `docker login`/`podman login` actually write
+// Docker Hub credentials under in config.json, for historical reasons.
+const dockerHubLegacyKey = "https://index.docker.io/v1/"
+
+// authKeyCandidates returns the config.json keys to try for host, in order.
+func authKeyCandidates(host string) []string {
+	if host == dockerHubRegistry {
+		return []string{host, dockerHubLegacyKey}
+	}
+	return []string{host}
+}
+
+// authForRegistry returns the authn.AuthConfig for host, trying the config
+// file's "auths" entry, then credHelpers[host], then the global credsStore.
+func (r *authResolver) authForRegistry(host string) (authn.AuthConfig, error) {
+	for _, key := range authKeyCandidates(host) {
+		if entry, ok := r.cfg.Auths[key]; ok && entry.Auth != "" {
+			return decodeBasicAuth(entry.Auth)
+		}
+	}
+
+	if helper, ok := r.cfg.CredHelpers[host]; ok {
+		return runCredHelper(helper, host)
+	}
+
+	if r.cfg.CredsStore != "" {
+		return runCredHelper(r.cfg.CredsStore, host)
+	}
+
+	return authn.AuthConfig{}, nil
+}
+
+func decodeBasicAuth(encoded string) (authn.AuthConfig, error) {
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return authn.AuthConfig{}, fmt.Errorf("could not decode auth entry: %w", err)
+	}
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 {
+		return authn.AuthConfig{}, fmt.Errorf("malformed auth entry")
+	}
+	return authn.AuthConfig{Username: parts[0], Password: parts[1]}, nil
+}
+
+// credHelperOutput mirrors the JSON a docker-credential-<name> helper writes
+// to stdout for a "get" request.
+type credHelperOutput struct {
+	Username string `json:"Username"`
+	Secret   string `json:"Secret"`
+}
+
+// runCredHelper invokes the docker-credential-<name> protocol: the registry
+// host is written to stdin, and {"Username", "Secret"} is read from stdout.
+func runCredHelper(name, host string) (authn.AuthConfig, error) {
+	bin := "docker-credential-" + name
+	cmd := exec.Command(bin, "get") // #nosec G204 -- name comes from a trusted docker/podman config file
+	cmd.Stdin = strings.NewReader(host)
+
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if err := cmd.Run(); err != nil {
+		return authn.AuthConfig{}, fmt.Errorf("could not run %s: %w", bin, err)
+	}
+
+	var creds credHelperOutput
+	if err := json.Unmarshal(out.Bytes(), &creds); err != nil {
+		return authn.AuthConfig{}, fmt.Errorf("could not parse %s output: %w", bin, err)
+	}
+	return authn.AuthConfig{Username: creds.Username, Password: creds.Secret}, nil
+}
+
+// imagePullSecretResolver resolves credentials from a Kubernetes
+// imagePullSecret of type kubernetes.io/dockerconfigjson.
+type imagePullSecretResolver struct {
+	cfg dockerConfig
+}
+
+func newImagePullSecretResolver(clientset kubernetes.Interface, nsName string) (*imagePullSecretResolver, error) {
+	parts := strings.SplitN(nsName, "/", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("--image-pull-secret expects <namespace>/<name>, got %s", nsName)
+	}
+	ns, name := parts[0], parts[1]
+
+	secret, err := clientset.CoreV1().Secrets(ns).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch image pull secret %s: %w", nsName, err)
+	}
+
+	raw, ok := secret.Data[".dockerconfigjson"]
+	if !ok {
+		return nil, fmt.Errorf("secret %s has no .dockerconfigjson entry", nsName)
+	}
+
+	var cfg dockerConfig
+	if err := json.Unmarshal(raw, &cfg); err != nil {
+		return nil, fmt.Errorf("could not parse .dockerconfigjson on %s: %w", nsName, err)
+	}
+	return &imagePullSecretResolver{cfg: cfg}, nil
+}
+
+func (r *imagePullSecretResolver) authForRegistry(host string) (authn.AuthConfig, error) {
+	for _, key := range authKeyCandidates(host) {
+		if entry, ok := r.cfg.Auths[key]; ok && entry.Auth != "" {
+			return decodeBasicAuth(entry.Auth)
+		}
+	}
+	return authn.AuthConfig{}, nil
+}
+
+var sharedAuthResolver *authResolver
+var sharedImagePullSecretResolver *imagePullSecretResolver
+
+// registryAuthenticator returns the authn.Authenticator for host, sourced
+// from --registry-auth-file / the docker or podman config, a credential
+// helper, or an imagePullSecret, in that order. Returns authn.Anonymous when
+// no credentials are configured for host.
+func registryAuthenticator(host string) authn.Authenticator {
+	if sharedAuthResolver == nil {
+		var err error
+		sharedAuthResolver, err = newAuthResolver()
+		if err != nil {
+			log.WithError(err).Warn("could not load registry credentials")
+			sharedAuthResolver = &authResolver{}
+		}
+	}
+
+	cfg, err := sharedAuthResolver.authForRegistry(host)
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"registry": host,
+		}).Warn("could not resolve registry credentials")
+		return authn.Anonymous
+	}
+	if cfg.Username != "" || cfg.Password != "" {
+		return authn.FromConfig(cfg)
+	}
+
+	if cfg, ok := imagePullSecretAuth(host); ok {
+		return authn.FromConfig(cfg)
+	}
+
+	return authn.Anonymous
+}
+
+// imagePullSecretAuth falls back to the --image-pull-secret when the docker
+// config resolver found nothing for host.
+func imagePullSecretAuth(host string) (authn.AuthConfig, bool) {
+	if imagePullSecret == "" || imagePullSecretClientset == nil {
+		return authn.AuthConfig{}, false
+	}
+
+	if sharedImagePullSecretResolver == nil {
+		var err error
+		sharedImagePullSecretResolver, err = newImagePullSecretResolver(imagePullSecretClientset, imagePullSecret)
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"imagePullSecret": imagePullSecret,
+			}).Warn("could not load image pull secret")
+			return authn.AuthConfig{}, false
+		}
+	}
+
+	cfg, err := sharedImagePullSecretResolver.authForRegistry(host)
+	if err != nil || (cfg.Username == "" && cfg.Password == "") {
+		return authn.AuthConfig{}, false
+	}
+	return cfg, true
+}
@@ -0,0 +1,71 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2022 Authors of KubeArmor
+
+package recommend
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestAuthKeyCandidatesDockerHubLegacyKey(t *testing.T) {
+	// docker login/podman login write Docker Hub credentials under
+	// "https://index.docker.io/v1/", not the normalized "index.docker.io"
+	// go-containerregistry resolves references to.
+	got := authKeyCandidates(dockerHubRegistry)
+	want := []string{dockerHubRegistry, dockerHubLegacyKey}
+	assertStringSlice(t, "authKeyCandidates(dockerHubRegistry)", got, want)
+
+	got = authKeyCandidates("ghcr.io")
+	want = []string{"ghcr.io"}
+	assertStringSlice(t, "authKeyCandidates(ghcr.io)", got, want)
+}
+
+func TestDecodeBasicAuth(t *testing.T) {
+	encoded := base64.StdEncoding.EncodeToString([]byte("alice:hunter2"))
+	cfg, err := decodeBasicAuth(encoded)
+	if err != nil {
+		t.Fatalf("decodeBasicAuth: %v", err)
+	}
+	if cfg.Username != "alice" || cfg.Password != "hunter2" {
+		t.Fatalf("got %+v, want alice/hunter2", cfg)
+	}
+}
+
+func TestDecodeBasicAuthMalformed(t *testing.T) {
+	if _, err := decodeBasicAuth("not-base64!"); err == nil {
+		t.Fatal("expected an error for invalid base64")
+	}
+
+	noColon := base64.StdEncoding.EncodeToString([]byte("no-colon-here"))
+	if _, err := decodeBasicAuth(noColon); err == nil {
+		t.Fatal("expected an error for an entry with no ':'")
+	}
+}
+
+func TestAuthForRegistryFallsBackToDockerHubLegacyKey(t *testing.T) {
+	r := &authResolver{cfg: dockerConfig{
+		Auths: map[string]dockerConfigAuth{
+			dockerHubLegacyKey: {Auth: base64.StdEncoding.EncodeToString([]byte("alice:hunter2"))},
+		},
+	}}
+
+	cfg, err := r.authForRegistry(dockerHubRegistry)
+	if err != nil {
+		t.Fatalf("authForRegistry: %v", err)
+	}
+	if cfg.Username != "alice" || cfg.Password != "hunter2" {
+		t.Fatalf("got %+v, want alice/hunter2 resolved via the legacy Docker Hub key", cfg)
+	}
+}
+
+func TestAuthForRegistryNoCredentials(t *testing.T) {
+	r := &authResolver{}
+	cfg, err := r.authForRegistry("ghcr.io")
+	if err != nil {
+		t.Fatalf("authForRegistry: %v", err)
+	}
+	if cfg.Username != "" || cfg.Password != "" {
+		t.Fatalf("got %+v, want an empty AuthConfig", cfg)
+	}
+}
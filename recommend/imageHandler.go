@@ -4,23 +4,18 @@
 package recommend
 
 import (
-	"archive/tar"
-	"bufio"
 	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"io"
-	"math/rand"
 	"os"
 	"path/filepath"
-	"regexp"
 	"strings"
-	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/client"
 	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/google/go-containerregistry/pkg/name"
 	"github.com/moby/term"
 	log "github.com/sirupsen/logrus"
 )
@@ -36,13 +31,52 @@ type ImageInfo struct {
 	OS       string
 	FileList []string
 	DirList  []string
+
+	// Ref is the resolved image reference used to fetch the image.
+	Ref string
+	// PullMode records which ImageSource ultimately supplied the image.
+	PullMode PullMode
+	// Platform is the manifest-list entry that was selected, when the
+	// image was published as a multi-arch manifest list or OCI image index.
+	Platform Platform
+
+	// VerifiedDigest and SigningIdentity are filled in when --verify-signature
+	// is set, so the verified provenance can be annotated on the generated policy.
+	VerifiedDigest  string
+	SigningIdentity string
+	// Annotations holds the verified provenance (see VerifiedDigest/SigningIdentity)
+	// as annotation key/value pairs. It is logged by getImageDetails;
+	// getPolicyFromImageInfo does not read it, so the generated policy does
+	// not carry these annotations.
+	Annotations map[string]string
 }
 
-func getAuthStr() string {
+const (
+	annotationVerifiedDigest  = "kubearmor.io/verified-digest"
+	annotationSigningIdentity = "kubearmor.io/signing-identity"
+)
+
+// getAuthStr returns the base64-encoded docker API auth string for
+// imageName's registry. DOCKER_USERNAME/DOCKER_PASSWORD take priority for
+// backwards compatibility; otherwise credentials are resolved the way
+// docker/podman do, via registryAuthenticator.
+func getAuthStr(imageName string) string {
 	u := os.Getenv("DOCKER_USERNAME")
 	p := os.Getenv("DOCKER_PASSWORD")
+
 	if u == "" || p == "" {
-		return ""
+		host := registryHost(imageName)
+		cfg, err := registryAuthenticator(host).Authorization()
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"registry": host,
+			}).Warn("could not resolve registry credentials")
+			return ""
+		}
+		u, p = cfg.Username, cfg.Password
+		if u == "" && p == "" {
+			return ""
+		}
 	}
 
 	encodedJSON, err := json.Marshal(types.AuthConfig{
@@ -56,19 +90,37 @@ func getAuthStr() string {
 	return base64.URLEncoding.EncodeToString(encodedJSON)
 }
 
+// registryHost extracts the registry host imageName belongs to, e.g.
+// "index.docker.io" for "nginx:latest" or "ghcr.io" for "ghcr.io/org/app:tag".
+func registryHost(imageName string) string {
+	n, err := name.ParseReference(imageName)
+	if err != nil {
+		return ""
+	}
+	return n.Context().RegistryStr()
+}
+
 func init() {
 	var err error
 
-	rand.Seed(time.Now().UnixNano()) // random seed init for random string generator
-
 	cli, err = client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
-		log.WithError(err).Fatal("could not create new docker client")
+		// no local docker daemon is not fatal: resolveImageSource() falls
+		// back to a direct registry pull in that case.
+		log.WithError(err).Info("could not create docker client, daemonless image sources only")
+		cli = nil
 	}
 }
 
 func pullImage(imageName string) error {
-	out, err := cli.ImagePull(context.Background(), imageName, types.ImagePullOptions{RegistryAuth: getAuthStr()})
+	if cli == nil {
+		return fmt.Errorf("no docker daemon available to pull %s from", imageName)
+	}
+
+	out, err := cli.ImagePull(context.Background(), imageName, types.ImagePullOptions{
+		RegistryAuth: getAuthStr(imageName),
+		Platform:     effectivePlatform().String(),
+	})
 	if err != nil {
 		log.WithError(err).Fatal("could not pull image")
 	}
@@ -83,17 +135,6 @@ func pullImage(imageName string) error {
 	return nil
 }
 
-// The randomizer used in this function is not used for any cryptographic
-// operation and hence safe to use.
-func randString(n int) string {
-	var letterRunes = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
-	b := make([]rune, n)
-	for i := range b {
-		b[i] = letterRunes[rand.Intn(len(letterRunes))] // #nosec
-	}
-	return string(b)
-}
-
 func closeCheckErr(f *os.File, fname string) {
 	err := f.Close()
 	if err != nil {
@@ -113,185 +154,74 @@ func sanitizeArchivePath(d, t string) (v string, err error) {
 	return "", fmt.Errorf("%s: %s", "content filepath is tainted", t)
 }
 
-func extractTar(tarname string) ([]string, []string) {
-	var fl []string
-	var dl []string
+// digestPart returns the "sha256:..." suffix of a digest-pinned reference
+// ("repo@sha256:..."), or "" if ref carries no digest.
+func digestPart(ref string) string {
+	if i := strings.LastIndex(ref, "@"); i != -1 {
+		return ref[i+1:]
+	}
+	return ""
+}
+
+// getImageDetails fetches ref (which imageHandler has already pinned to the
+// verified digest, when verification is configured) and builds the policy
+// recommendation for it. requestedName is the original, possibly-mutable
+// reference the user asked for, kept only for display (ImageInfo.Name).
+func getImageDetails(requestedName, ref, identity string, src ImageSource) error {
+	var img ImageInfo
+	img.Name = requestedName
+	img.Ref = ref
+	img.PullMode = src.Mode()
 
-	f, err := os.Open(filepath.Clean(tarname))
-	if err != nil {
-		log.WithError(err).WithFields(log.Fields{
-			"tar": tarname,
-		}).Fatal("os create failed")
+	if verifyOpts.RequireVerification {
+		img.VerifiedDigest = digestPart(ref)
+		img.SigningIdentity = identity
+	}
+	if img.VerifiedDigest != "" {
+		img.Annotations = map[string]string{annotationVerifiedDigest: img.VerifiedDigest}
+		if identity != "" {
+			img.Annotations[annotationSigningIdentity] = identity
+		}
+		log.WithFields(log.Fields{
+			"image":       requestedName,
+			"annotations": img.Annotations,
+		}).Info("recording verified image provenance")
 	}
-	defer closeCheckErr(f, tarname)
 
-	tr := tar.NewReader(bufio.NewReader(f))
-	for {
-		hdr, err := tr.Next()
-		if err == io.EOF {
-			break // End of archive
+	if src.Mode() == PullModeDaemon {
+		// streams `docker save` straight into the same whiteout-aware tar
+		// extraction the daemonless sources use below, instead of dumping
+		// the whole image to disk first.
+		if err := extractFromDaemon(context.Background(), &img); err != nil {
+			log.WithError(err).Fatal("could not extract image from daemon")
 		}
+
+		// the platform pulled is whatever was requested (or the host
+		// platform, absent a request) -- no need to go through the
+		// ImageSource again just to read it back, which would make
+		// daemon.Image() do yet another docker save of the same image.
+		img.Platform = effectivePlatform()
+	} else {
+		// daemonless sources stream layers directly, without ever dumping
+		// the whole image to disk first.
+		v1img, err := src.Fetch(context.Background(), ref)
 		if err != nil {
-			log.WithError(err).Fatal("tar next failed")
+			log.WithError(err).Fatal("could not fetch image")
 		}
 
-		tgt, err := sanitizeArchivePath(tempDir, hdr.Name)
+		img.FileList, img.DirList, err = streamExtract(v1img)
 		if err != nil {
-			log.WithError(err).WithFields(log.Fields{
-				"file": hdr.Name,
-			}).Error("ignoring file since it could not be sanitized")
-			continue
+			log.WithError(err).Fatal("could not extract image layers")
 		}
 
-		switch hdr.Typeflag {
-		case tar.TypeDir:
-			if _, err := os.Stat(tgt); err != nil {
-				if err := os.MkdirAll(tgt, 0750); err != nil {
-					log.WithError(err).WithFields(log.Fields{
-						"target": tgt,
-					}).Fatal("tar mkdirall")
-				}
-			}
-			dl = append(dl, tgt)
-		case tar.TypeReg:
-			f, err := os.OpenFile(filepath.Clean(tgt), os.O_CREATE|os.O_RDWR, os.FileMode(hdr.Mode))
-			if err != nil {
-				log.WithError(err).WithFields(log.Fields{
-					"target": tgt,
-				}).Fatal("tar open file")
-			}
-
-			// copy over contents
-			if _, err := io.CopyN(f, tr, 2e+8 /*200MB*/); err != io.EOF {
-				log.WithError(err).WithFields(log.Fields{
-					"target": tgt,
-				}).Fatal("tar io.Copy()")
-			}
-			closeCheckErr(f, tgt)
-			if strings.HasSuffix(tgt, "layer.tar") { // deflate container image layer
-				ifl, idl := extractTar(tgt)
-				fl = append(fl, ifl...)
-				dl = append(dl, idl...)
-			} else {
-				fl = append(fl, tgt)
-			}
+		if err := getImageInfoFromV1(&img, v1img); err != nil {
+			log.WithError(err).Fatal("could not read image config")
 		}
-	}
-	return fl, dl
-}
-
-func saveImageToTar(imageName string) string {
-	imgdata, err := cli.ImageSave(context.Background(), []string{imageName})
-	if err != nil {
-		log.WithError(err).Fatal("could not save image")
-	}
-	defer imgdata.Close()
-
-	tarname := filepath.Join(tempDir, randString(8)+".tar")
-
-	f, err := os.Create(filepath.Clean(tarname))
-	if err != nil {
-		log.WithError(err).Fatal("os create failed")
-	}
-
-	if _, err := io.CopyN(bufio.NewWriter(f), imgdata, 5e+9 /*5GB*/); err != io.EOF {
-		log.WithError(err).WithFields(log.Fields{
-			"tar": tarname,
-		}).Fatal("io.CopyN() failed")
-	}
-	closeCheckErr(f, tarname)
-	log.WithFields(log.Fields{
-		"tar": tarname,
-	}).Info("dumped image to tar")
-	return tarname
-}
 
-func checkForSpec(spec string, fl []string) []string {
-	var matches []string
-	re := regexp.MustCompile(spec)
-	for _, name := range fl {
-		if re.Match([]byte(name)) {
-			matches = append(matches, name)
+		if c, ok := src.(cleanupSource); ok {
+			c.Cleanup()
 		}
 	}
-	return matches
-}
-
-func getFileBytes(fname string) ([]byte, error) {
-	f, err := os.Open(filepath.Clean(fname))
-	if err != nil {
-		log.WithFields(log.Fields{
-			"file": fname,
-		}).Fatal("open file failed")
-	}
-	defer closeCheckErr(f, fname)
-	return io.ReadAll(f)
-}
-
-func readManifest(img *ImageInfo, manifest string) {
-	// read manifest file
-	barr, err := getFileBytes(manifest)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"manifest": manifest,
-		}).Fatal("manifest read failed")
-	}
-	var manres []map[string]interface{}
-	err = json.Unmarshal(barr, &manres)
-	if err != nil {
-		log.WithError(err).Fatal("manifest json unmarshal failed")
-	}
-	if len(manres) != 1 {
-		log.WithFields(log.Fields{
-			"len":     len(manres),
-			"results": manres,
-		}).Fatal("expecting one config in manifest!")
-	}
-	// 	man := manres.(map[string]interface{})
-
-	// read config file
-	config := filepath.Join(tempDir, manres[0]["Config"].(string))
-	barr, err = getFileBytes(config)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"config": config,
-		}).Fatal("config read failed")
-	}
-	var cfgres map[string]interface{}
-	err = json.Unmarshal(barr, &cfgres)
-	if err != nil {
-		log.WithError(err).Fatal("config json unmarshal failed")
-	}
-	img.Arch = cfgres["architecture"].(string)
-	img.OS = cfgres["os"].(string)
-	for _, tag := range manres[0]["RepoTags"].([]interface{}) {
-		img.RepoTags = append(img.RepoTags, tag.(string))
-		// img.RepoTags = manres[0]["RepoTags"].([]interface{}).([]string)
-	}
-}
-
-func getImageInfo(img *ImageInfo) {
-	matches := checkForSpec(filepath.Join(tempDir, "manifest.json"), img.FileList)
-	if len(matches) != 1 {
-		log.WithFields(log.Fields{
-			"len":     len(matches),
-			"matches": matches,
-		}).Fatal("expecting one manifest.json!")
-	}
-	readManifest(img, matches[0])
-}
-
-func getImageDetails(imageName string) error {
-	var img ImageInfo
-	img.Name = imageName
-	// step 1: save the image to a tar file
-	tarname := saveImageToTar(imageName)
-
-	// step 2: retrieve information from tar
-	img.FileList, img.DirList = extractTar(tarname)
-
-	// step 3: getImageInfo
-	getImageInfo(&img)
 
 	getPolicyFromImageInfo(&img)
 	// Check if os == linux
@@ -300,19 +230,40 @@ func getImageDetails(imageName string) error {
 	return nil
 }
 
+// Image pulls imageName (through whichever ImageSource applies, honoring any
+// platform/verification/auth options set via SetPlatform/SetVerifyOptions/
+// SetAuthOptions) and generates a KubeArmor policy recommendation for it.
+// This is the entry point the recommend command calls into.
+func Image(imageName string) error {
+	return imageHandler(imageName)
+}
+
+// imageHandler resolves imageName, verifies it (if configured) and pulls and
+// extracts exactly the artifact that was verified. Verification runs before
+// anything is pulled: a floating tag can change between a verify and a
+// later, separate pull, so everything downstream is pinned to the verified
+// digest rather than re-resolving imageName.
 func imageHandler(imageName string) error {
-	log.WithFields(log.Fields{
-		"image": imageName,
-	}).Info("pulling image")
-	err := pullImage(imageName)
+	src := resolveImageSource(imageName)
+
+	ref, identity, err := verifyImage(context.Background(), imageName)
 	if err != nil {
-		return err
+		return fmt.Errorf("refusing to generate a policy from an unverified image: %w", err)
+	}
+	if ref == "" {
+		ref = imageName
 	}
 
-	err = getImageDetails(imageName)
-	if err != nil {
-		return err
+	log.WithFields(log.Fields{
+		"image": ref,
+		"mode":  src.Mode(),
+	}).Info("pulling image")
+
+	if src.Mode() == PullModeDaemon {
+		if err := pullImage(ref); err != nil {
+			return err
+		}
 	}
 
-	return nil
+	return getImageDetails(imageName, ref, identity, src)
 }
@@ -0,0 +1,160 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2022 Authors of KubeArmor
+
+package recommend
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+
+	"github.com/docker/docker/client"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/daemon"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	log "github.com/sirupsen/logrus"
+)
+
+// PullMode records where an image was ultimately pulled from.
+type PullMode string
+
+const (
+	// PullModeDaemon means the image was fetched from a running docker/podman daemon
+	PullModeDaemon PullMode = "daemon"
+	// PullModeRemote means the image was fetched directly from the registry
+	PullModeRemote PullMode = "remote"
+	// PullModeOCILayout means the image was read from an on-disk OCI layout or archive
+	PullModeOCILayout PullMode = "oci-layout"
+)
+
+// Platform identifies a single entry of a multi-arch manifest list / OCI
+// image index.
+type Platform struct {
+	OS      string
+	Arch    string
+	Variant string
+}
+
+// requestedPlatform is set by the recommend command's --platform flag; nil
+// means "use the host platform".
+var requestedPlatform *Platform
+
+// SetPlatform configures the platform recommend should select when pulling
+// from a manifest list or OCI image index. An empty arch leaves the
+// selection unset, so the host platform is used instead.
+func SetPlatform(os, arch, variant string) {
+	if arch == "" {
+		requestedPlatform = nil
+		return
+	}
+	requestedPlatform = &Platform{OS: os, Arch: arch, Variant: variant}
+}
+
+// effectivePlatform returns the platform to select, defaulting to the host
+// platform when none was requested.
+func effectivePlatform() Platform {
+	if requestedPlatform != nil {
+		return *requestedPlatform
+	}
+	return Platform{OS: runtime.GOOS, Arch: runtime.GOARCH}
+}
+
+func (p Platform) v1Platform() v1.Platform {
+	return v1.Platform{OS: p.OS, Architecture: p.Arch, Variant: p.Variant}
+}
+
+// String renders p the way the docker daemon's --platform expects it:
+// "os/arch" or "os/arch/variant".
+func (p Platform) String() string {
+	if p.Variant != "" {
+		return fmt.Sprintf("%s/%s/%s", p.OS, p.Arch, p.Variant)
+	}
+	return fmt.Sprintf("%s/%s", p.OS, p.Arch)
+}
+
+// ImageSource abstracts where image content comes from, so recommend can run
+// with or without a local container engine.
+type ImageSource interface {
+	// Fetch resolves ref against this source and returns the fetched image.
+	Fetch(ctx context.Context, ref string) (v1.Image, error)
+	// Mode identifies this source for ImageInfo.PullMode.
+	Mode() PullMode
+}
+
+// cleanupSource is implemented by ImageSources that stage temporary on-disk
+// state in Fetch (e.g. unpacking an archive) and need to remove it once the
+// image has been fully read.
+type cleanupSource interface {
+	Cleanup()
+}
+
+// daemonImageSource fetches images from a running docker daemon.
+type daemonImageSource struct {
+	cli *client.Client
+}
+
+func (d *daemonImageSource) Fetch(ctx context.Context, ref string) (v1.Image, error) {
+	n, err := name.ParseReference(ref)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse reference %s: %w", ref, err)
+	}
+	return daemon.Image(n, daemon.WithClient(d.cli), daemon.WithContext(ctx))
+}
+
+func (d *daemonImageSource) Mode() PullMode { return PullModeDaemon }
+
+// remoteImageSource fetches images directly from a registry, without a
+// local container engine.
+type remoteImageSource struct {
+	options []remote.Option
+}
+
+func (r *remoteImageSource) Fetch(ctx context.Context, ref string) (v1.Image, error) {
+	n, err := name.ParseReference(ref)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse reference %s: %w", ref, err)
+	}
+
+	plat := effectivePlatform()
+	opts := append([]remote.Option{
+		remote.WithContext(ctx),
+		remote.WithPlatform(plat.v1Platform()),
+		remote.WithAuth(registryAuthenticator(n.Context().RegistryStr())),
+	}, r.options...)
+
+	// remote.Image transparently resolves a manifest list / OCI image index
+	// to the manifest matching opts' platform.
+	return remote.Image(n, opts...)
+}
+
+func (r *remoteImageSource) Mode() PullMode { return PullModeRemote }
+
+// daemonAvailable returns true when a docker daemon is reachable.
+func daemonAvailable(cli *client.Client) bool {
+	if cli == nil {
+		return false
+	}
+	_, err := cli.Ping(context.Background())
+	return err == nil
+}
+
+// resolveImageSource picks an ImageSource for imageName: an oci: or
+// oci-archive: reference always wins (there is nothing to pull), otherwise
+// the daemon is used when reachable, falling through to a direct registry
+// pull.
+func resolveImageSource(imageName string) ImageSource {
+	if isOCILayoutRef(imageName) {
+		return &ociLayoutImageSource{}
+	}
+
+	if daemonAvailable(cli) {
+		return &daemonImageSource{cli: cli}
+	}
+
+	log.WithFields(log.Fields{
+		"image": imageName,
+	}).Info("no docker daemon available, falling back to direct registry pull")
+	return &remoteImageSource{}
+}
@@ -0,0 +1,193 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2022 Authors of KubeArmor
+
+package recommend
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	ociLayoutPrefix  = "oci:"
+	ociArchivePrefix = "oci-archive:"
+)
+
+// isOCILayoutRef reports whether ref points at a local OCI image layout
+// (oci:path[:tag]) or an oci-archive: tarball, rather than a registry image.
+func isOCILayoutRef(ref string) bool {
+	return strings.HasPrefix(ref, ociLayoutPrefix) || strings.HasPrefix(ref, ociArchivePrefix)
+}
+
+// ociLayoutImageSource reads an already-materialized OCI image layout
+// (index.json + blobs/sha256/...) or an oci-archive: tarball of one,
+// bypassing pullImage and the docker daemon entirely.
+type ociLayoutImageSource struct {
+	// extractedDir holds the scratch directory an oci-archive: reference was
+	// unpacked into, so Cleanup can remove it once the image has been read.
+	extractedDir string
+}
+
+func (o *ociLayoutImageSource) Mode() PullMode { return PullModeOCILayout }
+
+// Cleanup removes any scratch directory an oci-archive: reference was
+// extracted into. It is a no-op for oci: references, which read the
+// caller-supplied layout directory directly. getImageDetails calls this once
+// the image has been fully read; a failed fetch or extraction exits before
+// that, leaving the extracted directory in place.
+func (o *ociLayoutImageSource) Cleanup() {
+	if o.extractedDir == "" {
+		return
+	}
+	if err := os.RemoveAll(o.extractedDir); err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"dir": o.extractedDir,
+		}).Warn("could not remove oci-archive extraction dir")
+	}
+}
+
+func (o *ociLayoutImageSource) Fetch(ctx context.Context, ref string) (v1.Image, error) {
+	switch {
+	case strings.HasPrefix(ref, ociArchivePrefix):
+		return o.fetchArchive(strings.TrimPrefix(ref, ociArchivePrefix))
+	case strings.HasPrefix(ref, ociLayoutPrefix):
+		return o.fetchLayout(strings.TrimPrefix(ref, ociLayoutPrefix))
+	default:
+		return nil, fmt.Errorf("not an oci layout reference: %s", ref)
+	}
+}
+
+func (o *ociLayoutImageSource) fetchLayout(rest string) (v1.Image, error) {
+	path, tag := splitPathTag(rest)
+
+	idx, err := layout.ImageIndexFromPath(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open oci layout %s: %w", path, err)
+	}
+	return imageFromIndex(idx, tag)
+}
+
+func (o *ociLayoutImageSource) fetchArchive(rest string) (v1.Image, error) {
+	path, tag := splitPathTag(rest)
+
+	dir, err := os.MkdirTemp(tempDir, "oci-archive-")
+	if err != nil {
+		return nil, fmt.Errorf("could not create extraction dir: %w", err)
+	}
+	o.extractedDir = dir
+
+	if err := extractPlainTar(path, dir); err != nil {
+		return nil, fmt.Errorf("could not extract oci-archive %s: %w", path, err)
+	}
+
+	idx, err := layout.ImageIndexFromPath(dir)
+	if err != nil {
+		return nil, fmt.Errorf("%s does not contain a valid oci layout: %w", path, err)
+	}
+	return imageFromIndex(idx, tag)
+}
+
+// splitPathTag splits "path" or "path:tag" the way oci:/oci-archive:
+// references are written.
+func splitPathTag(rest string) (path string, tag string) {
+	path = rest
+	if i := strings.LastIndex(rest, ":"); i > 0 {
+		path, tag = rest[:i], rest[i+1:]
+	}
+	return path, tag
+}
+
+// imageFromIndex follows idx's index.json to a manifest: the sole manifest
+// when there's just one; otherwise, when tag is set, the one whose
+// "org.opencontainers.image.ref.name" annotation matches it (an error if none
+// does); otherwise the one matching effectivePlatform() by OS and
+// architecture (the variant is not compared).
+func imageFromIndex(idx v1.ImageIndex, tag string) (v1.Image, error) {
+	manifest, err := idx.IndexManifest()
+	if err != nil {
+		return nil, fmt.Errorf("could not read index manifest: %w", err)
+	}
+
+	if len(manifest.Manifests) == 1 {
+		return idx.Image(manifest.Manifests[0].Digest)
+	}
+
+	if tag != "" {
+		for _, desc := range manifest.Manifests {
+			if desc.Annotations["org.opencontainers.image.ref.name"] == tag {
+				return idx.Image(desc.Digest)
+			}
+		}
+		return nil, fmt.Errorf("no manifest tagged %q in oci layout", tag)
+	}
+
+	want := effectivePlatform()
+	for _, desc := range manifest.Manifests {
+		if desc.Platform == nil {
+			continue
+		}
+		if desc.Platform.OS == want.OS && desc.Platform.Architecture == want.Arch {
+			return idx.Image(desc.Digest)
+		}
+	}
+	return nil, fmt.Errorf("no manifest for platform %s/%s in oci layout", want.OS, want.Arch)
+}
+
+// extractPlainTar extracts src (a plain, uncompressed tar, as written by
+// `docker save`/`buildah push oci-archive:` for an OCI layout) into dst,
+// preserving directory structure. Gzip-compressed archives are not handled.
+func extractPlainTar(src, dst string) error {
+	f, err := os.Open(filepath.Clean(src))
+	if err != nil {
+		return err
+	}
+	defer closeCheckErr(f, src)
+
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		tgt, err := sanitizeArchivePath(dst, hdr.Name)
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"file": hdr.Name,
+			}).Error("ignoring file since it could not be sanitized")
+			continue
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(tgt, 0750); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(tgt), 0750); err != nil {
+				return err
+			}
+			out, err := os.OpenFile(filepath.Clean(tgt), os.O_CREATE|os.O_RDWR, os.FileMode(hdr.Mode))
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(out, tr); err != nil { // #nosec G110 -- OCI layout blobs, size already bounded by the registry/build tooling that produced them
+				closeCheckErr(out, tgt)
+				return err
+			}
+			closeCheckErr(out, tgt)
+		}
+	}
+}
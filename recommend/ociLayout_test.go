@@ -0,0 +1,159 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2022 Authors of KubeArmor
+
+package recommend
+
+import (
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+)
+
+func TestIsOCILayoutRef(t *testing.T) {
+	cases := map[string]bool{
+		"oci:/tmp/layout":            true,
+		"oci:/tmp/layout:v1":         true,
+		"oci-archive:/tmp/image.tar": true,
+		"docker.io/library/nginx":    false,
+		"nginx:latest":               false,
+	}
+	for ref, want := range cases {
+		if got := isOCILayoutRef(ref); got != want {
+			t.Errorf("isOCILayoutRef(%q) = %v, want %v", ref, got, want)
+		}
+	}
+}
+
+func TestSplitPathTag(t *testing.T) {
+	cases := []struct {
+		rest     string
+		wantPath string
+		wantTag  string
+	}{
+		{"/tmp/layout", "/tmp/layout", ""},
+		{"/tmp/layout:v1", "/tmp/layout", "v1"},
+		{"/tmp/my:layout:v1", "/tmp/my:layout", "v1"},
+	}
+	for _, c := range cases {
+		path, tag := splitPathTag(c.rest)
+		if path != c.wantPath || tag != c.wantTag {
+			t.Errorf("splitPathTag(%q) = (%q, %q), want (%q, %q)", c.rest, path, tag, c.wantPath, c.wantTag)
+		}
+	}
+}
+
+// appendManifest adds img to idx under the given tag annotation and/or
+// platform, the way an OCI image index records each entry.
+func appendManifest(t *testing.T, idx v1.ImageIndex, img v1.Image, tag string, plat *v1.Platform) v1.ImageIndex {
+	t.Helper()
+
+	add := mutate.IndexAddendum{
+		Add: img,
+		Descriptor: v1.Descriptor{
+			Platform: plat,
+		},
+	}
+	if tag != "" {
+		add.Descriptor.Annotations = map[string]string{"org.opencontainers.image.ref.name": tag}
+	}
+	return mutate.AppendManifests(idx, add)
+}
+
+func TestImageFromIndexSingleManifest(t *testing.T) {
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("random.Image: %v", err)
+	}
+	idx := appendManifest(t, empty.Index, img, "", nil)
+
+	got, err := imageFromIndex(idx, "")
+	if err != nil {
+		t.Fatalf("imageFromIndex: %v", err)
+	}
+	assertSameImage(t, got, img)
+}
+
+func TestImageFromIndexByTag(t *testing.T) {
+	wantImg, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("random.Image: %v", err)
+	}
+	otherImg, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("random.Image: %v", err)
+	}
+
+	idx := empty.Index
+	idx = appendManifest(t, idx, otherImg, "other", nil)
+	idx = appendManifest(t, idx, wantImg, "wanted", nil)
+
+	got, err := imageFromIndex(idx, "wanted")
+	if err != nil {
+		t.Fatalf("imageFromIndex: %v", err)
+	}
+	assertSameImage(t, got, wantImg)
+}
+
+func TestImageFromIndexByPlatform(t *testing.T) {
+	SetPlatform("linux", "arm64", "")
+	defer SetPlatform("", "", "")
+
+	wantImg, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("random.Image: %v", err)
+	}
+	otherImg, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("random.Image: %v", err)
+	}
+
+	idx := empty.Index
+	idx = appendManifest(t, idx, otherImg, "", &v1.Platform{OS: "linux", Architecture: "amd64"})
+	idx = appendManifest(t, idx, wantImg, "", &v1.Platform{OS: "linux", Architecture: "arm64"})
+
+	got, err := imageFromIndex(idx, "")
+	if err != nil {
+		t.Fatalf("imageFromIndex: %v", err)
+	}
+	assertSameImage(t, got, wantImg)
+}
+
+func TestImageFromIndexNoMatch(t *testing.T) {
+	SetPlatform("linux", "arm64", "")
+	defer SetPlatform("", "", "")
+
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("random.Image: %v", err)
+	}
+	otherImg, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("random.Image: %v", err)
+	}
+
+	idx := empty.Index
+	idx = appendManifest(t, idx, img, "", &v1.Platform{OS: "linux", Architecture: "amd64"})
+	idx = appendManifest(t, idx, otherImg, "", &v1.Platform{OS: "windows", Architecture: "amd64"})
+
+	if _, err := imageFromIndex(idx, ""); err == nil {
+		t.Fatal("expected an error when no manifest matches the requested platform")
+	}
+}
+
+func assertSameImage(t *testing.T, got, want v1.Image) {
+	t.Helper()
+	gotDigest, err := got.Digest()
+	if err != nil {
+		t.Fatalf("got.Digest: %v", err)
+	}
+	wantDigest, err := want.Digest()
+	if err != nil {
+		t.Fatalf("want.Digest: %v", err)
+	}
+	if gotDigest != wantDigest {
+		t.Fatalf("got image digest %s, want %s", gotDigest, wantDigest)
+	}
+}
@@ -0,0 +1,240 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2022 Authors of KubeArmor
+
+package recommend
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// streamExtract walks img's layers in manifest order, streaming each
+// compressed layer blob through a gzip reader into an in-memory tar.Reader,
+// instead of writing the whole image to disk first. Whiteout entries
+// (".wh.") are applied as they're seen, so files deleted by a later layer
+// never show up in the returned lists.
+func streamExtract(img v1.Image) ([]string, []string, error) {
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not list layers: %w", err)
+	}
+
+	files := make(map[string]struct{})
+	dirs := make(map[string]struct{})
+
+	for _, layer := range layers {
+		if err := applyLayer(layer, files, dirs); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return sortedKeys(files), sortedKeys(dirs), nil
+}
+
+func applyLayer(layer v1.Layer, files, dirs map[string]struct{}) error {
+	rc, err := layer.Compressed()
+	if err != nil {
+		return fmt.Errorf("could not read layer blob: %w", err)
+	}
+	defer rc.Close()
+
+	gzr, err := gzip.NewReader(rc)
+	if err != nil {
+		return fmt.Errorf("could not open layer gzip stream: %w", err)
+	}
+	defer gzr.Close()
+
+	return applyTarEntries(tar.NewReader(gzr), files, dirs)
+}
+
+// applyTarEntries walks the entries of an already-uncompressed layer tar,
+// applying whiteouts the same way applyLayer does. It is shared by the
+// gzip-compressed registry/OCI layer path (applyLayer) and the plain,
+// uncompressed layer.tar entries a "docker save" stream contains
+// (extractFromDaemon).
+func applyTarEntries(tr *tar.Reader, files, dirs map[string]struct{}) error {
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("tar next failed: %w", err)
+		}
+
+		name := path.Clean("/" + hdr.Name)
+		base := path.Base(name)
+		dir := path.Dir(name)
+
+		switch {
+		case base == whiteoutOpaque:
+			// opaque whiteout: hide everything a lower layer put under dir,
+			// but dir itself stays (this layer still owns that directory)
+			removeDescendants(files, dir)
+			removeDescendants(dirs, dir)
+			continue
+		case strings.HasPrefix(base, whiteoutPrefix):
+			deleted := path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix))
+			delete(files, deleted)
+			delete(dirs, deleted)
+			removeUnder(files, deleted)
+			removeUnder(dirs, deleted)
+			continue
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			dirs[name] = struct{}{}
+		default:
+			files[name] = struct{}{}
+			delete(dirs, name) // a later layer may replace a dir with a regular file
+		}
+	}
+}
+
+// extractFromDaemon streams `docker save ref` straight into a tar.Reader and
+// fills in img's file/dir lists and config-derived fields, the same way
+// streamExtract does for the daemonless sources, without ever writing the
+// image to disk. A "docker save" tar has no fixed entry order, but since it
+// always describes exactly one image here, every layer.tar found belongs to
+// that image and can be applied as it's seen; only the handful of small json
+// blobs (config, manifest) need to be buffered until both sides are read.
+func extractFromDaemon(ctx context.Context, img *ImageInfo) error {
+	if cli == nil {
+		return fmt.Errorf("no docker daemon available to save %s from", img.Ref)
+	}
+
+	rc, err := cli.ImageSave(ctx, []string{img.Ref})
+	if err != nil {
+		return fmt.Errorf("could not save image: %w", err)
+	}
+	defer rc.Close()
+
+	files := make(map[string]struct{})
+	dirs := make(map[string]struct{})
+	configBlobs := make(map[string][]byte)
+	var manifestBytes []byte
+
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("tar next failed: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		switch {
+		case hdr.Name == "manifest.json":
+			if manifestBytes, err = io.ReadAll(tr); err != nil {
+				return fmt.Errorf("manifest read failed: %w", err)
+			}
+		case strings.HasSuffix(hdr.Name, "/layer.tar"):
+			if err := applyTarEntries(tar.NewReader(tr), files, dirs); err != nil {
+				return fmt.Errorf("could not extract %s: %w", hdr.Name, err)
+			}
+		case strings.HasSuffix(hdr.Name, ".json"):
+			b, err := io.ReadAll(tr)
+			if err != nil {
+				return fmt.Errorf("could not read %s: %w", hdr.Name, err)
+			}
+			configBlobs[hdr.Name] = b
+		}
+	}
+
+	if manifestBytes == nil {
+		return fmt.Errorf("docker save output for %s had no manifest.json", img.Ref)
+	}
+
+	var manres []map[string]interface{}
+	if err := json.Unmarshal(manifestBytes, &manres); err != nil {
+		return fmt.Errorf("manifest json unmarshal failed: %w", err)
+	}
+	if len(manres) != 1 {
+		return fmt.Errorf("expecting one config in manifest, got %d", len(manres))
+	}
+
+	configName, _ := manres[0]["Config"].(string)
+	cfgBytes, ok := configBlobs[configName]
+	if !ok {
+		return fmt.Errorf("manifest references missing config %s", configName)
+	}
+
+	var cfgres map[string]interface{}
+	if err := json.Unmarshal(cfgBytes, &cfgres); err != nil {
+		return fmt.Errorf("config json unmarshal failed: %w", err)
+	}
+
+	img.Arch, _ = cfgres["architecture"].(string)
+	img.OS, _ = cfgres["os"].(string)
+	for _, t := range manres[0]["RepoTags"].([]interface{}) {
+		img.RepoTags = append(img.RepoTags, t.(string))
+	}
+	img.FileList = sortedKeys(files)
+	img.DirList = sortedKeys(dirs)
+	return nil
+}
+
+// getImageInfoFromV1 fills in the config-derived fields of img (arch, os,
+// repo tags) from an already-fetched v1.Image, mirroring what
+// extractFromDaemon does for the docker-save tar path.
+func getImageInfoFromV1(img *ImageInfo, v1img v1.Image) error {
+	cfg, err := v1img.ConfigFile()
+	if err != nil {
+		return fmt.Errorf("could not read image config: %w", err)
+	}
+
+	img.Arch = cfg.Architecture
+	img.OS = cfg.OS
+	img.Platform = Platform{OS: cfg.OS, Arch: cfg.Architecture, Variant: cfg.Variant}
+	if img.Name != "" {
+		img.RepoTags = []string{img.Name}
+	}
+	return nil
+}
+
+// removeUnder deletes every entry of set that lives at or below prefix.
+func removeUnder(set map[string]struct{}, prefix string) {
+	for name := range set {
+		if name == prefix || strings.HasPrefix(name, prefix+"/") {
+			delete(set, name)
+		}
+	}
+}
+
+// removeDescendants deletes every entry of set that lives strictly below
+// prefix, leaving prefix itself (if present) untouched.
+func removeDescendants(set map[string]struct{}, prefix string) {
+	for name := range set {
+		if strings.HasPrefix(name, prefix+"/") {
+			delete(set, name)
+		}
+	}
+}
+
+func sortedKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
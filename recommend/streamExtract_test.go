@@ -0,0 +1,91 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2022 Authors of KubeArmor
+
+package recommend
+
+import (
+	"archive/tar"
+	"bytes"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// newRawLayer builds a v1.Layer out of the given tar entry names, the way a
+// real image layer blob looks on the wire. Names ending in "/" are written
+// as directories.
+func newRawLayer(t *testing.T, names []string) v1.Layer {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range names {
+		hdr := &tar.Header{Name: name}
+		if name[len(name)-1] == '/' {
+			hdr.Typeflag = tar.TypeDir
+		} else {
+			hdr.Typeflag = tar.TypeReg
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("write header %s: %v", name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("close tar writer: %v", err)
+	}
+
+	layer, err := tarball.LayerFromReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("build layer: %v", err)
+	}
+	return layer
+}
+
+// TestApplyLayerWhiteouts checks that a regular whiteout ("/etc/.wh.shadow")
+// removes just the named file, and an opaque whiteout
+// ("/var/log/.wh..wh..opq") hides everything a lower layer put under that
+// directory, so neither shows up in the final file/dir lists.
+func TestApplyLayerWhiteouts(t *testing.T) {
+	base := newRawLayer(t, []string{
+		"etc/",
+		"etc/passwd",
+		"etc/shadow",
+		"var/",
+		"var/log/",
+		"var/log/app.log",
+	})
+
+	upper := newRawLayer(t, []string{
+		"etc/.wh.shadow",
+		"var/log/.wh..wh..opq",
+	})
+
+	files := make(map[string]struct{})
+	dirs := make(map[string]struct{})
+
+	if err := applyLayer(base, files, dirs); err != nil {
+		t.Fatalf("apply base layer: %v", err)
+	}
+	if err := applyLayer(upper, files, dirs); err != nil {
+		t.Fatalf("apply upper layer: %v", err)
+	}
+
+	wantFiles := []string{"/etc/passwd"}
+	wantDirs := []string{"/etc", "/var", "/var/log"}
+
+	assertStringSlice(t, "files", sortedKeys(files), wantFiles)
+	assertStringSlice(t, "dirs", sortedKeys(dirs), wantDirs)
+}
+
+func assertStringSlice(t *testing.T, what string, got, want []string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("%s: got %v, want %v", what, got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("%s: got %v, want %v", what, got, want)
+		}
+	}
+}
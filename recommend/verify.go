@@ -0,0 +1,173 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2022 Authors of KubeArmor
+
+package recommend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/sigstore/cosign/v2/pkg/cosign"
+	ociremote "github.com/sigstore/cosign/v2/pkg/oci/remote"
+	"github.com/sigstore/sigstore/pkg/signature"
+	log "github.com/sirupsen/logrus"
+	"github.com/theupdateframework/notary/client"
+)
+
+// VerifyOptions configures the optional trust gate recommend runs before
+// generating a policy from an image. When RequireVerification is set,
+// imageHandler refuses to continue past a failed or missing signature.
+type VerifyOptions struct {
+	RequireVerification bool
+
+	// cosign/Sigstore
+	CosignKeyPath        string // path to a public key, e.g. cosign.pub
+	CosignCertIdentity   string // keyless: expected certificate identity
+	CosignCertOIDCIssuer string // keyless: expected certificate OIDC issuer
+
+	// Notary v1 / TUF
+	NotaryServer string
+}
+
+// verifyOpts is set by the recommend command's --verify-signature and
+// related flags.
+var verifyOpts VerifyOptions
+
+// SetVerifyOptions configures the trust gate used by imageHandler.
+func SetVerifyOptions(opts VerifyOptions) {
+	verifyOpts = opts
+}
+
+func (o VerifyOptions) usesCosign() bool {
+	return o.CosignKeyPath != "" || (o.CosignCertIdentity != "" && o.CosignCertOIDCIssuer != "")
+}
+
+// verifyImage checks ref's signature according to verifyOpts and returns the
+// verified, digest-pinned reference (e.g. "repo@sha256:...") and the signing
+// identity, to be recorded on ImageInfo. The caller must fetch that pinned
+// reference for everything downstream, not the original (mutable) ref, or
+// verification is a no-op against a tag that can change between the check
+// and the pull. When verification is not configured, pinnedRef is "".
+func verifyImage(ctx context.Context, ref string) (pinnedRef string, identity string, err error) {
+	if !verifyOpts.RequireVerification {
+		return "", "", nil
+	}
+
+	switch {
+	case verifyOpts.usesCosign():
+		return verifyCosign(ctx, ref)
+	case verifyOpts.NotaryServer != "":
+		return verifyNotary(ref)
+	default:
+		return "", "", fmt.Errorf("--verify-signature requires --cosign-key, --cosign-cert-identity/--cosign-cert-oidc-issuer, or --notary-server")
+	}
+}
+
+// verifyCosign resolves ref to a digest and verifies its Sigstore signature,
+// either against a supplied public key or, for keyless signing, against a
+// Fulcio certificate identity/issuer pair backed by a Rekor transparency log
+// entry. It returns the digest-pinned reference ("repo@sha256:...") so the
+// caller can fetch exactly what was verified.
+func verifyCosign(ctx context.Context, ref string) (string, string, error) {
+	n, err := name.ParseReference(ref)
+	if err != nil {
+		return "", "", fmt.Errorf("could not parse reference %s: %w", ref, err)
+	}
+
+	regOpts := []ociremote.Option{
+		ociremote.WithRemoteOptions(remote.WithAuth(registryAuthenticator(n.Context().RegistryStr()))),
+	}
+
+	checkOpts := &cosign.CheckOpts{
+		ClaimVerifier:      cosign.SimpleClaimVerifier,
+		RegistryClientOpts: regOpts,
+	}
+
+	if verifyOpts.CosignKeyPath != "" {
+		verifier, err := signature.LoadPublicKey(ctx, verifyOpts.CosignKeyPath)
+		if err != nil {
+			return "", "", fmt.Errorf("could not load cosign public key: %w", err)
+		}
+		checkOpts.SigVerifier = verifier
+	} else {
+		checkOpts.CertIdentity = verifyOpts.CosignCertIdentity
+		checkOpts.CertOidcIssuer = verifyOpts.CosignCertOIDCIssuer
+		checkOpts.RekorClient, err = cosign.NewRekorClient("")
+		if err != nil {
+			return "", "", fmt.Errorf("could not create rekor client: %w", err)
+		}
+	}
+
+	digest, err := cosign.ResolveDigest(n, regOpts...)
+	if err != nil {
+		return "", "", fmt.Errorf("could not resolve digest for %s: %w", ref, err)
+	}
+
+	sigs, bundleVerified, err := cosign.VerifyImageSignatures(ctx, digest, checkOpts)
+	if err != nil || len(sigs) == 0 {
+		return "", "", fmt.Errorf("signature verification failed for %s: %w", ref, err)
+	}
+
+	pinnedRef := digest.String()
+	identity := verifyOpts.CosignCertIdentity
+	log.WithFields(log.Fields{
+		"image":          ref,
+		"digest":         pinnedRef,
+		"bundleVerified": bundleVerified,
+	}).Info("cosign signature verified")
+
+	return pinnedRef, identity, nil
+}
+
+// verifyNotary resolves ref through a notary server to its signed digest, so
+// the pull can be pinned to that digest rather than a mutable tag.
+func verifyNotary(ref string) (string, string, error) {
+	n, err := name.ParseReference(ref)
+	if err != nil {
+		return "", "", fmt.Errorf("could not parse reference %s: %w", ref, err)
+	}
+
+	repo, err := client.NewFileCachedRepository(
+		"",
+		client.GUN(n.Context().Name()),
+		verifyOpts.NotaryServer,
+		authenticatedTransport(n.Context().RegistryStr()), nil, client.Use(client.LocalDefault),
+	)
+	if err != nil {
+		return "", "", fmt.Errorf("could not reach notary server %s: %w", verifyOpts.NotaryServer, err)
+	}
+
+	target, err := repo.GetTargetByName(n.Identifier())
+	if err != nil {
+		return "", "", fmt.Errorf("no signed target %s on notary server: %w", n.Identifier(), err)
+	}
+
+	pinnedRef := n.Context().Name() + "@sha256:" + target.Hashes["sha256"].String()
+	return pinnedRef, "notary:" + verifyOpts.NotaryServer, nil
+}
+
+// authenticatedTransport wraps the default transport with basic auth
+// resolved via registryAuthenticator, so the notary client honors the same
+// docker/podman credentials as the daemonless image sources.
+func authenticatedTransport(host string) http.RoundTripper {
+	cfg, err := registryAuthenticator(host).Authorization()
+	if err != nil || (cfg.Username == "" && cfg.Password == "") {
+		return http.DefaultTransport
+	}
+	return &basicAuthTransport{base: http.DefaultTransport, username: cfg.Username, password: cfg.Password}
+}
+
+type basicAuthTransport struct {
+	base               http.RoundTripper
+	username, password string
+}
+
+func (t *basicAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.SetBasicAuth(t.username, t.password)
+	return t.base.RoundTrip(req)
+}